@@ -0,0 +1,206 @@
+// Copyright © 2020 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package dartsass provides a libsass.Transpiler backed by the Dart Sass
+// Embedded protocol, communicating with a dart-sass-embedded binary over
+// stdin/stdout instead of linking against LibSass via cgo. It exists so
+// that callers can switch between the two backends by configuration alone.
+package dartsass
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bep/golibsass/libsass"
+)
+
+// Options configures the Dart Sass Embedded backend. The embedded
+// libsass.Options cover the settings shared with the LibSass backend
+// (include paths, output style, import resolution, source maps); the
+// field below is specific to locating and running the subprocess.
+type Options struct {
+	libsass.Options
+
+	// DartSassEmbeddedFilename is the path to the dart-sass-embedded
+	// binary. If empty, it is looked up on $PATH.
+	DartSassEmbeddedFilename string
+}
+
+// transpiler is a libsass.Transpiler that drives a long-lived
+// dart-sass-embedded subprocess. A single transpiler can service many
+// concurrent Execute calls; each gets its own compilation id so responses
+// and import callbacks are routed back to the right caller.
+type transpiler struct {
+	options Options
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+
+	writeMu sync.Mutex
+
+	nextID  uint32
+	pendMu  sync.Mutex
+	pending map[uint32]chan compileResult
+	// dead is set once readLoop exits, so Execute calls made after the
+	// subprocess has gone away fail immediately instead of registering a
+	// channel nothing will ever write to.
+	dead error
+}
+
+type compileResult struct {
+	result libsass.Result
+	err    error
+}
+
+// New starts a dart-sass-embedded subprocess and returns a libsass.Transpiler
+// that compiles SCSS/SASS through it.
+func New(options Options) (libsass.Transpiler, error) {
+	binName := options.DartSassEmbeddedFilename
+	if binName == "" {
+		binName = "dart-sass-embedded"
+	}
+
+	bin, err := exec.LookPath(binName)
+	if err != nil {
+		return nil, fmt.Errorf("dartsass: %q not found: %w", binName, err)
+	}
+
+	cmd := exec.Command(bin)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("dartsass: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("dartsass: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("dartsass: starting %q: %w", bin, err)
+	}
+
+	t := &transpiler{
+		options: options,
+		cmd:     cmd,
+		stdin:   stdin,
+		stdout:  bufio.NewReader(stdout),
+		pending: make(map[uint32]chan compileResult),
+	}
+
+	go t.readLoop()
+
+	return t, nil
+}
+
+// Execute transpiles the SCSS or SASS in src to CSS by round-tripping a
+// CompileRequest/CompileResponse pair with the dart-sass-embedded process.
+func (t *transpiler) Execute(src string) (libsass.Result, error) {
+	id := atomic.AddUint32(&t.nextID, 1)
+
+	ch := make(chan compileResult, 1)
+	t.pendMu.Lock()
+	if t.dead != nil {
+		err := t.dead
+		t.pendMu.Unlock()
+		return libsass.Result{}, err
+	}
+	t.pending[id] = ch
+	t.pendMu.Unlock()
+
+	t.writeMu.Lock()
+	err := writePacket(t.stdin, newCompileRequest(id, src, t.options))
+	t.writeMu.Unlock()
+
+	if err != nil {
+		t.pendMu.Lock()
+		delete(t.pending, id)
+		t.pendMu.Unlock()
+		return libsass.Result{}, fmt.Errorf("dartsass: sending compile request: %w", err)
+	}
+
+	res := <-ch
+	return res.result, res.err
+}
+
+// Batch compiles many inputs concurrently, capped at GOMAXPROCS in flight
+// at a time; see libsass.RunBatch.
+func (t *transpiler) Batch(inputs []libsass.Input) []libsass.BatchResult {
+	return libsass.RunBatch(t.Execute, inputs)
+}
+
+// Close terminates the dart-sass-embedded subprocess.
+func (t *transpiler) Close() error {
+	t.stdin.Close()
+	return t.cmd.Wait()
+}
+
+// readLoop dispatches incoming packets to the Execute call waiting on their
+// compilation id, resolving ImportRequest messages against the configured
+// ImportResolver along the way.
+func (t *transpiler) readLoop() {
+	for {
+		payload, err := readPacket(t.stdout)
+		if err != nil {
+			t.failAll(fmt.Errorf("dartsass: reading from dart-sass-embedded: %w", err))
+			return
+		}
+
+		msg, err := parseOutboundMessage(payload)
+		if err != nil {
+			t.failAll(err)
+			return
+		}
+		if msg == nil {
+			// LogEvent, VersionResponse, or a top-level protocol Error -
+			// none of which affect any in-flight or future Execute call.
+			continue
+		}
+
+		switch m := msg.(type) {
+		case importRequest:
+			t.handleImportRequest(m)
+		case compileResponse:
+			t.pendMu.Lock()
+			ch, ok := t.pending[m.id]
+			delete(t.pending, m.id)
+			t.pendMu.Unlock()
+			if ok {
+				ch <- m.toCompileResult()
+			}
+		}
+	}
+}
+
+func (t *transpiler) handleImportRequest(req importRequest) {
+	var newURL, body string
+	var resolved bool
+	if resolver := t.options.ImportResolver; resolver != nil {
+		newURL, body, resolved = resolver(req.url, req.previousURL)
+	}
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_ = writePacket(t.stdin, newImportResponse(req.id, newURL, body, resolved))
+}
+
+// failAll latches err as the transpiler's terminal state, so that Execute
+// calls racing with or arriving after this one are rejected immediately
+// instead of blocking forever on a response that will never come, then
+// rejects every Execute call currently waiting with err.
+func (t *transpiler) failAll(err error) {
+	t.pendMu.Lock()
+	defer t.pendMu.Unlock()
+	t.dead = err
+	for id, ch := range t.pending {
+		ch <- compileResult{err: err}
+		delete(t.pending, id)
+	}
+}
@@ -0,0 +1,503 @@
+// Copyright © 2020 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package dartsass
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/bep/golibsass/libsass"
+)
+
+// The Dart Sass Embedded protocol exchanges protobuf messages over
+// stdin/stdout, each one prefixed by its length as a base-128 varint (see
+// the "Packets" section of the Embedded Sass protocol spec). This file
+// hand-rolls the subset of that schema Execute/readLoop need - the
+// InboundMessage/OutboundMessage envelopes, CompileRequest with its
+// StringInput and Importer submessages, and CompileResponse with its
+// Success/Failure submessages - rather than take on a protoc-gen-go
+// dependency and the protoc toolchain it requires. Field numbers below are
+// a best-effort hand port of embedded_sass.proto; this should be replaced
+// with generated bindings the first time protoc is available to run
+// against the real .proto.
+
+// Field numbers for the InboundMessage/OutboundMessage oneofs.
+const (
+	inboundCompileRequest = 1
+	inboundImportResponse = 3
+
+	outboundCompileResponse = 2
+	outboundImportRequest   = 4
+)
+
+// Field numbers within CompileRequest. The source itself is never field 2
+// directly - it's the `source` field of a StringInput submessage at field
+// 2, since CompileRequest.input is a oneof that can alternatively hold a
+// plain path to a file on disk (field 3, unused here: Execute always
+// compiles an in-memory src string). Search directories for IncludePaths,
+// and our custom ImportResolver, are both sent as repeated Importer
+// submessages, not as a flat repeated string.
+const (
+	fieldCompileID        = 1
+	fieldCompileString    = 2
+	fieldCompilePath      = 3
+	fieldCompileImporters = 4
+	fieldCompileStyle     = 5
+	fieldCompileSourceMap = 6
+)
+
+// Field numbers within the CompileRequest.string submessage (StringInput).
+const (
+	fieldStringSource = 1
+	fieldStringURL    = 2
+	fieldStringSyntax = 3
+)
+
+// Dart Sass Embedded's Syntax enum. SCSS is 0, so it's also the wire
+// default - uint64Field never writes it.
+const (
+	dartSyntaxSCSS = 0
+	dartSyntaxSASS = 1
+)
+
+// Field numbers within an Importer submessage. We only ever send one of
+// two alternatives: a filesystem directory to search (for
+// Options.IncludePaths), or a reference to our single registered
+// ImportResolver.
+const (
+	fieldImporterLoadPath   = 3
+	fieldImporterImporterID = 4
+)
+
+// importResolverID is the fixed id our single ImportResolver, if any, is
+// registered under. Dart Sass echoes it back on every ImportRequest; we
+// don't currently need to distinguish importers by it since a transpiler
+// only ever has the one.
+const importResolverID = 1
+
+// Field numbers within CompileResponse. Results come back as a oneof:
+// Success (css/source_map) on a clean compile, Failure (message/span) on
+// an error - never as flat fields alongside `id`.
+const (
+	fieldResponseID      = 1
+	fieldResponseSuccess = 2
+	fieldResponseFailure = 3
+)
+
+// Field numbers within CompileResponse.Success.
+const (
+	fieldSuccessCSS       = 1
+	fieldSuccessSourceMap = 2
+)
+
+// Field numbers within CompileResponse.Failure.
+const (
+	fieldFailureMessage = 1
+	fieldFailureSpan    = 2
+)
+
+// Field numbers within a SourceSpan.
+const (
+	fieldSpanStart = 1
+	fieldSpanURL   = 3
+)
+
+// Field numbers within a SourceLocation. Dart Sass reports these 0-based;
+// libsass.Error.Line/Column are 1-based, so parseCompileResponse adds 1.
+const (
+	fieldLocationLine   = 2
+	fieldLocationColumn = 3
+)
+
+// Field numbers within ImportRequest/ImportResponse.
+const (
+	fieldImportReqID         = 1
+	fieldImportReqURL        = 2
+	fieldImportReqImporterID = 3
+	fieldImportReqPrev       = 4
+
+	fieldImportRespID       = 1
+	fieldImportRespURL      = 2
+	fieldImportRespContents = 3
+	fieldImportRespResolved = 4
+)
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) varint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *protoWriter) uint64Field(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 0)
+	w.varint(v)
+}
+
+func (w *protoWriter) boolField(field int, v bool) {
+	if !v {
+		return
+	}
+	w.tag(field, 0)
+	w.varint(1)
+}
+
+func (w *protoWriter) stringField(field int, v string) {
+	if v == "" {
+		return
+	}
+	w.tag(field, 2)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+// embeddedField appends a nested message as a length-delimited field.
+// Unlike stringField/uint64Field it always writes, even for an empty
+// payload, since an embedded message's presence (as opposed to its being
+// the zero value) is what a oneof like CompileRequest.input selects on.
+func (w *protoWriter) embeddedField(field int, payload []byte) {
+	w.tag(field, 2)
+	w.varint(uint64(len(payload)))
+	w.buf = append(w.buf, payload...)
+}
+
+func wrapMessage(field int, payload []byte) []byte {
+	w := &protoWriter{}
+	w.embeddedField(field, payload)
+	return w.buf
+}
+
+// writePacket writes a length-prefixed message to w.
+func writePacket(w io.Writer, payload []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(payload)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readPacket reads one length-prefixed message from r.
+func readPacket(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+type protoField struct {
+	num  int
+	wire int
+	u64  uint64
+	buf  []byte
+}
+
+// parseFields does a single flat pass over a protobuf message, collecting
+// each field's raw value. Nested submessages are left as raw bytes in buf
+// for the caller to run back through parseFields; it's all the decoding
+// the messages in this package need.
+func parseFields(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := protoUvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("dartsass: malformed protobuf tag")
+		}
+		b = b[n:]
+
+		field := protoField{num: int(tag >> 3), wire: int(tag & 0x7)}
+		switch field.wire {
+		case 0:
+			v, n := protoUvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("dartsass: malformed varint")
+			}
+			field.u64 = v
+			b = b[n:]
+		case 2:
+			l, n := protoUvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("dartsass: malformed length")
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return nil, fmt.Errorf("dartsass: truncated message")
+			}
+			field.buf = b[:l]
+			b = b[l:]
+		default:
+			return nil, fmt.Errorf("dartsass: unsupported wire type %d", field.wire)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func protoUvarint(b []byte) (uint64, int) {
+	var x uint64
+	var s uint
+	for i, c := range b {
+		if c < 0x80 {
+			if i > 9 || (i == 9 && c > 1) {
+				return 0, -1
+			}
+			return x | uint64(c)<<s, i + 1
+		}
+		x |= uint64(c&0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
+
+// The Embedded Protocol's OutputStyle enum only has two values, unlike
+// golibsass's four. EXPANDED is 0, so it's also the wire default -
+// uint64Field never writes it.
+const (
+	dartOutputStyleExpanded   = 0
+	dartOutputStyleCompressed = 1
+)
+
+// dartOutputStyle maps a golibsass OutputStyle onto the two styles Dart
+// Sass actually supports: CompressedStyle goes to COMPRESSED, everything
+// else (NestedStyle, ExpandedStyle, CompactStyle) goes to EXPANDED, which
+// is the closest match LibSass's own fallback would pick anyway.
+func dartOutputStyle(s libsass.OutputStyle) int {
+	if s == libsass.CompressedStyle {
+		return dartOutputStyleCompressed
+	}
+	return dartOutputStyleExpanded
+}
+
+// newStringInput builds a StringInput submessage: the SCSS/SASS source
+// itself, plus the syntax to parse it as and the URL it should be
+// reported under (e.g. in error messages and as the base for relative
+// imports).
+func newStringInput(src string, syntax int, url string) []byte {
+	w := &protoWriter{}
+	w.stringField(fieldStringSource, src)
+	w.stringField(fieldStringURL, url)
+	w.uint64Field(fieldStringSyntax, uint64(syntax))
+	return w.buf
+}
+
+// newImporters builds the repeated Importer submessages for a compile:
+// one per entry in Options.IncludePaths, plus one referencing our single
+// registered ImportResolver, if any.
+func newImporters(options Options) []byte {
+	w := &protoWriter{}
+	for _, path := range options.IncludePaths {
+		imp := &protoWriter{}
+		imp.stringField(fieldImporterLoadPath, path)
+		w.embeddedField(fieldCompileImporters, imp.buf)
+	}
+	if options.ImportResolver != nil {
+		imp := &protoWriter{}
+		imp.uint64Field(fieldImporterImporterID, uint64(importResolverID))
+		w.embeddedField(fieldCompileImporters, imp.buf)
+	}
+	return w.buf
+}
+
+func newCompileRequest(id uint32, src string, options Options) []byte {
+	syntax := dartSyntaxSCSS
+	if options.SassSyntax {
+		syntax = dartSyntaxSASS
+	}
+
+	w := &protoWriter{}
+	w.uint64Field(fieldCompileID, uint64(id))
+	w.embeddedField(fieldCompileString, newStringInput(src, syntax, options.InputPath))
+	w.buf = append(w.buf, newImporters(options)...)
+	w.uint64Field(fieldCompileStyle, uint64(dartOutputStyle(options.OutputStyle)))
+	w.boolField(fieldCompileSourceMap, options.SourceMapFilename != "" || options.EnableEmbeddedSourceMap)
+	return wrapMessage(inboundCompileRequest, w.buf)
+}
+
+func newImportResponse(id uint32, url, contents string, resolved bool) []byte {
+	w := &protoWriter{}
+	w.uint64Field(fieldImportRespID, uint64(id))
+	w.stringField(fieldImportRespURL, url)
+	w.stringField(fieldImportRespContents, contents)
+	w.boolField(fieldImportRespResolved, resolved)
+	return wrapMessage(inboundImportResponse, w.buf)
+}
+
+type compileResponse struct {
+	id        uint32
+	css       string
+	sourceMap string
+
+	errMsg    string
+	errLine   int
+	errColumn int
+	errFile   string
+}
+
+func (r compileResponse) toCompileResult() compileResult {
+	if r.errMsg != "" {
+		return compileResult{err: libsass.Error{
+			Message: r.errMsg,
+			Line:    r.errLine,
+			Column:  r.errColumn,
+			File:    r.errFile,
+		}}
+	}
+	return compileResult{result: libsass.Result{CSS: r.css, SourceMapContent: r.sourceMap}}
+}
+
+func parseCompileResponse(b []byte) (compileResponse, error) {
+	fields, err := parseFields(b)
+	if err != nil {
+		return compileResponse{}, err
+	}
+
+	var r compileResponse
+	for _, f := range fields {
+		switch f.num {
+		case fieldResponseID:
+			r.id = uint32(f.u64)
+		case fieldResponseSuccess:
+			if err := parseCompileSuccess(f.buf, &r); err != nil {
+				return compileResponse{}, err
+			}
+		case fieldResponseFailure:
+			if err := parseCompileFailure(f.buf, &r); err != nil {
+				return compileResponse{}, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseCompileSuccess(b []byte, r *compileResponse) error {
+	fields, err := parseFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case fieldSuccessCSS:
+			r.css = string(f.buf)
+		case fieldSuccessSourceMap:
+			r.sourceMap = string(f.buf)
+		}
+	}
+	return nil
+}
+
+func parseCompileFailure(b []byte, r *compileResponse) error {
+	fields, err := parseFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case fieldFailureMessage:
+			r.errMsg = string(f.buf)
+		case fieldFailureSpan:
+			if err := parseSourceSpan(f.buf, r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseSourceSpan(b []byte, r *compileResponse) error {
+	fields, err := parseFields(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case fieldSpanURL:
+			r.errFile = string(f.buf)
+		case fieldSpanStart:
+			loc, err := parseFields(f.buf)
+			if err != nil {
+				return err
+			}
+			for _, lf := range loc {
+				switch lf.num {
+				case fieldLocationLine:
+					r.errLine = int(lf.u64) + 1
+				case fieldLocationColumn:
+					r.errColumn = int(lf.u64) + 1
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type importRequest struct {
+	id          uint32
+	importerID  uint32
+	url         string
+	previousURL string
+}
+
+func parseImportRequest(b []byte) (importRequest, error) {
+	fields, err := parseFields(b)
+	if err != nil {
+		return importRequest{}, err
+	}
+	var r importRequest
+	for _, f := range fields {
+		switch f.num {
+		case fieldImportReqID:
+			r.id = uint32(f.u64)
+		case fieldImportReqImporterID:
+			r.importerID = uint32(f.u64)
+		case fieldImportReqURL:
+			r.url = string(f.buf)
+		case fieldImportReqPrev:
+			r.previousURL = string(f.buf)
+		}
+	}
+	return r, nil
+}
+
+// parseOutboundMessage unwraps an OutboundMessage (dart-sass-embedded -> us)
+// and returns whichever of compileResponse/importRequest it carries. Any
+// other message type - LogEvent (emitted for @warn/@debug and deprecation
+// notices on an otherwise valid compile), VersionResponse, or the
+// top-level protocol Error - comes back as a nil, nil no-op: none of those
+// mean the transpiler can no longer be used, so readLoop must not treat
+// them as fatal.
+func parseOutboundMessage(payload []byte) (interface{}, error) {
+	fields, err := parseFields(payload)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case outboundCompileResponse:
+			return parseCompileResponse(f.buf)
+		case outboundImportRequest:
+			return parseImportRequest(f.buf)
+		}
+	}
+	return nil, nil
+}
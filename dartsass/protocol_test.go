@@ -0,0 +1,190 @@
+// Copyright © 2020 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package dartsass
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/bep/golibsass/libsass"
+)
+
+// TestCompileRequestResponseRoundTrip exercises the wire encoding/decoding
+// this package does without a real dart-sass-embedded subprocess: it builds
+// a CompileRequest the way Execute does, decodes it back field by field the
+// way a real embedded compiler would, then builds and decodes a
+// CompileResponse the way Execute does on the way back.
+func TestCompileRequestResponseRoundTrip(t *testing.T) {
+	options := Options{
+		Options: libsass.Options{
+			OutputStyle:  libsass.CompressedStyle,
+			IncludePaths: []string{"vendor/scss"},
+			InputPath:    "style.scss",
+		},
+	}
+
+	req := newCompileRequest(42, "a{color:red}", options)
+
+	var buf bytes.Buffer
+	if err := writePacket(&buf, req); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := readPacket(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := parseFields(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0].num != inboundCompileRequest {
+		t.Fatalf("expected a single field %d (CompileRequest), got %+v", inboundCompileRequest, fields)
+	}
+
+	compileFields, err := parseFields(fields[0].buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotID uint64
+	var gotStyle uint64
+	var stringInput []byte
+	var importerCount int
+	for _, f := range compileFields {
+		switch f.num {
+		case fieldCompileID:
+			gotID = f.u64
+		case fieldCompileStyle:
+			gotStyle = f.u64
+		case fieldCompileString:
+			stringInput = f.buf
+		case fieldCompileImporters:
+			importerCount++
+		}
+	}
+
+	if gotID != 42 {
+		t.Errorf("id = %d, want 42", gotID)
+	}
+	if gotStyle != dartOutputStyleCompressed {
+		t.Errorf("style = %d, want %d (COMPRESSED)", gotStyle, dartOutputStyleCompressed)
+	}
+	if importerCount != 1 {
+		t.Errorf("importer count = %d, want 1 (one IncludePaths entry)", importerCount)
+	}
+	if stringInput == nil {
+		t.Fatal("CompileRequest has no StringInput (field 2)")
+	}
+
+	stringFields, err := parseFields(stringInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotSource, gotURL string
+	for _, f := range stringFields {
+		switch f.num {
+		case fieldStringSource:
+			gotSource = string(f.buf)
+		case fieldStringURL:
+			gotURL = string(f.buf)
+		}
+	}
+	if gotSource != "a{color:red}" {
+		t.Errorf("StringInput.source = %q, want %q", gotSource, "a{color:red}")
+	}
+	if gotURL != "style.scss" {
+		t.Errorf("StringInput.url = %q, want %q", gotURL, "style.scss")
+	}
+
+	// Now the other direction: build a CompileResponse the way
+	// dart-sass-embedded would, and make sure Execute's decoder recovers it.
+	success := &protoWriter{}
+	success.stringField(fieldSuccessCSS, "a{color:red}")
+	resp := &protoWriter{}
+	resp.uint64Field(fieldResponseID, 42)
+	resp.embeddedField(fieldResponseSuccess, success.buf)
+
+	got, err := parseCompileResponse(resp.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.id != 42 {
+		t.Errorf("response id = %d, want 42", got.id)
+	}
+	if got.css != "a{color:red}" {
+		t.Errorf("response css = %q, want %q", got.css, "a{color:red}")
+	}
+
+	result := got.toCompileResult()
+	if result.err != nil {
+		t.Fatalf("toCompileResult() error = %v, want nil", result.err)
+	}
+	if result.result.CSS != "a{color:red}" {
+		t.Errorf("result.CSS = %q, want %q", result.result.CSS, "a{color:red}")
+	}
+}
+
+// TestCompileResponseFailure checks that a Failure response's SourceSpan
+// (0-based) is decoded into a 1-based libsass.Error.
+func TestCompileResponseFailure(t *testing.T) {
+	loc := &protoWriter{}
+	loc.uint64Field(fieldLocationLine, 4)
+	loc.uint64Field(fieldLocationColumn, 9)
+	span := &protoWriter{}
+	span.embeddedField(fieldSpanStart, loc.buf)
+	span.stringField(fieldSpanURL, "style.scss")
+	failure := &protoWriter{}
+	failure.stringField(fieldFailureMessage, "unexpected token")
+	failure.embeddedField(fieldFailureSpan, span.buf)
+	resp := &protoWriter{}
+	resp.uint64Field(fieldResponseID, 7)
+	resp.embeddedField(fieldResponseFailure, failure.buf)
+
+	got, err := parseCompileResponse(resp.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := got.toCompileResult()
+	sassErr, ok := result.err.(libsass.Error)
+	if !ok {
+		t.Fatalf("toCompileResult() error type = %T, want libsass.Error", result.err)
+	}
+	if sassErr.Message != "unexpected token" {
+		t.Errorf("Message = %q, want %q", sassErr.Message, "unexpected token")
+	}
+	if sassErr.Line != 5 {
+		t.Errorf("Line = %d, want 5 (0-based 4 + 1)", sassErr.Line)
+	}
+	if sassErr.Column != 10 {
+		t.Errorf("Column = %d, want 10 (0-based 9 + 1)", sassErr.Column)
+	}
+	if sassErr.File != "style.scss" {
+		t.Errorf("File = %q, want %q", sassErr.File, "style.scss")
+	}
+}
+
+// TestParseOutboundMessageUnknownType checks that an OutboundMessage field
+// number we don't recognise - e.g. LogEvent or VersionResponse - comes back
+// as a nil, nil no-op rather than an error, since readLoop treats any error
+// here as fatal to the whole transpiler.
+func TestParseOutboundMessageUnknownType(t *testing.T) {
+	logEvent := &protoWriter{}
+	logEvent.stringField(1, "Deprecation Warning: ...")
+	outbound := &protoWriter{}
+	const outboundLogEvent = 6
+	outbound.embeddedField(outboundLogEvent, logEvent.buf)
+
+	msg, err := parseOutboundMessage(outbound.buf)
+	if err != nil {
+		t.Fatalf("parseOutboundMessage() error = %v, want nil", err)
+	}
+	if msg != nil {
+		t.Fatalf("parseOutboundMessage() = %v, want nil", msg)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright © 2020 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package libsass
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bep/golibsass/internal/libsass"
+)
+
+// SassValueKind identifies which field(s) of a SassValue are meaningful.
+type SassValueKind int
+
+const (
+	SassNull SassValueKind = iota
+	SassNumber
+	SassString
+	SassBool
+	SassColor
+	SassList
+	SassMap
+	SassError
+)
+
+// SassListSeparator is the separator LibSass renders between a SassList's
+// items, e.g. `1, 2, 3` vs `1 2 3`. It's part of a Sass list's identity,
+// not just presentation: `join()` and `nth()` behave differently depending
+// on it.
+type SassListSeparator int
+
+const (
+	SassSeparatorComma SassListSeparator = iota
+	SassSeparatorSpace
+)
+
+// SassValue is the argument and return type for functions registered via
+// Options.Functions. It mirrors LibSass's `union Sass_Value`; only the
+// field(s) implied by Kind are meaningful.
+type SassValue struct {
+	Kind SassValueKind
+
+	Number float64
+	Unit   string
+
+	Str string
+
+	Bool bool
+
+	// R, G, B are in [0, 255], A in [0, 1], as in CSS rgba().
+	R, G, B, A float64
+
+	// List holds the entries of a Sass list. ListSeparator and
+	// ListBracketed round-trip the list's comma/space separator and
+	// `[...]` bracket flag - both are significant to how LibSass renders
+	// and operates on the list, not just how it prints.
+	List          []SassValue
+	ListSeparator SassListSeparator
+	ListBracketed bool
+
+	// Map holds the entries of a Sass map. Sass maps are ordered, so this
+	// is a slice of pairs rather than a Go map.
+	Map []SassMapEntry
+
+	// Message is used when Kind is SassError; it becomes a Sass error as
+	// if it had been raised by LibSass itself.
+	Message string
+}
+
+// SassMapEntry is one key/value pair of a SassValue of kind SassMap.
+type SassMapEntry struct {
+	Key   SassValue
+	Value SassValue
+}
+
+// sassValueFromC converts a raw Sass_Value handle, as passed to a
+// registered C function's arguments, into a SassValue.
+func sassValueFromC(v libsass.SassValueHandle) SassValue {
+	switch libsass.SassValueGetTag(v) {
+	case libsass.SassValueNumberTag:
+		return SassValue{Kind: SassNumber, Number: libsass.SassNumberGetValue(v), Unit: libsass.SassNumberGetUnit(v)}
+	case libsass.SassValueStringTag:
+		return SassValue{Kind: SassString, Str: libsass.SassStringGetValue(v)}
+	case libsass.SassValueBooleanTag:
+		return SassValue{Kind: SassBool, Bool: libsass.SassBooleanGetValue(v)}
+	case libsass.SassValueColorTag:
+		r, g, b, a := libsass.SassColorGetR(v), libsass.SassColorGetG(v), libsass.SassColorGetB(v), libsass.SassColorGetA(v)
+		return SassValue{Kind: SassColor, R: r, G: g, B: b, A: a}
+	case libsass.SassValueListTag:
+		n := libsass.SassListGetLength(v)
+		list := make([]SassValue, n)
+		for i := 0; i < n; i++ {
+			list[i] = sassValueFromC(libsass.SassListGetValue(v, i))
+		}
+		separator := SassSeparatorComma
+		if libsass.SassListGetSeparator(v) == libsass.SassSeparatorSpaceTag {
+			separator = SassSeparatorSpace
+		}
+		return SassValue{
+			Kind:          SassList,
+			List:          list,
+			ListSeparator: separator,
+			ListBracketed: libsass.SassListGetIsBracketed(v),
+		}
+	case libsass.SassValueMapTag:
+		n := libsass.SassMapGetLength(v)
+		entries := make([]SassMapEntry, n)
+		for i := 0; i < n; i++ {
+			entries[i] = SassMapEntry{
+				Key:   sassValueFromC(libsass.SassMapGetKey(v, i)),
+				Value: sassValueFromC(libsass.SassMapGetValue(v, i)),
+			}
+		}
+		return SassValue{Kind: SassMap, Map: entries}
+	default:
+		return SassValue{Kind: SassNull}
+	}
+}
+
+// sassValueToC converts a SassValue into a newly allocated Sass_Value,
+// ready to hand back to LibSass as a C function's return value.
+func sassValueToC(v SassValue) libsass.SassValueHandle {
+	switch v.Kind {
+	case SassNumber:
+		return libsass.SassMakeNumber(v.Number, v.Unit)
+	case SassString:
+		return libsass.SassMakeString(v.Str)
+	case SassBool:
+		return libsass.SassMakeBoolean(v.Bool)
+	case SassColor:
+		return libsass.SassMakeColor(v.R, v.G, v.B, v.A)
+	case SassList:
+		handles := make([]libsass.SassValueHandle, len(v.List))
+		for i, e := range v.List {
+			handles[i] = sassValueToC(e)
+		}
+		separator := libsass.SassSeparatorCommaTag
+		if v.ListSeparator == SassSeparatorSpace {
+			separator = libsass.SassSeparatorSpaceTag
+		}
+		return libsass.SassMakeList(handles, separator, v.ListBracketed)
+	case SassMap:
+		m := libsass.SassMakeMap()
+		for _, e := range v.Map {
+			libsass.SassMapSet(m, sassValueToC(e.Key), sassValueToC(e.Value))
+		}
+		return m
+	case SassError:
+		return libsass.SassMakeError(v.Message)
+	default:
+		return libsass.SassMakeNull()
+	}
+}
+
+// validateFunctionSignatures checks that every Options.Functions key is a
+// full LibSass function signature, e.g. "image-url($path)", rather than a
+// bare name. sass_make_function derives the function's arity and
+// parameter names from the signature; a bare "image-url" registers a
+// zero-argument function, so any image-url($path) call in SCSS errors
+// with a wrong number of arguments instead of invoking the Go function.
+func validateFunctionSignatures(fns map[string]func(args []SassValue) (SassValue, error)) error {
+	for sig := range fns {
+		open := strings.IndexByte(sig, '(')
+		if open <= 0 || !strings.HasSuffix(sig, ")") {
+			return fmt.Errorf("libsass: Functions key %q is not a LibSass function signature, want something like \"name($arg1, $arg2)\"", sig)
+		}
+	}
+	return nil
+}
+
+// adaptFunctions bridges the public Options.Functions map to the signature
+// internal/libsass's C function trampoline expects, converting Sass_Value
+// handles to and from SassValue at the boundary.
+func adaptFunctions(fns map[string]func(args []SassValue) (SassValue, error)) map[string]func(argv []libsass.SassValueHandle) libsass.SassValueHandle {
+	adapted := make(map[string]func(argv []libsass.SassValueHandle) libsass.SassValueHandle, len(fns))
+	for name, fn := range fns {
+		fn := fn
+		adapted[name] = func(argv []libsass.SassValueHandle) libsass.SassValueHandle {
+			args := make([]SassValue, len(argv))
+			for i, a := range argv {
+				args[i] = sassValueFromC(a)
+			}
+			result, err := fn(args)
+			if err != nil {
+				return sassValueToC(SassValue{Kind: SassError, Message: err.Error()})
+			}
+			return sassValueToC(result)
+		}
+	}
+	return adapted
+}
@@ -10,22 +10,37 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/bep/golibsass/internal/libsass"
 )
 
+// libsassTranspiler is a Transpiler whose Options are fixed at New and
+// never mutated afterwards, so one instance can be configured once and
+// then issue many Execute/Batch calls, concurrently, without the caller
+// re-specifying Options each time. It does not pool the underlying
+// Sass_Data_Context/Sass_Compiler: each Execute still builds and tears
+// those down for its own compile, which is inherent to the C API tying a
+// compiler to a single source string rather than something this type
+// avoids.
 type libsassTranspiler struct {
 	options Options
 }
 
 // New creates a new libsass transpiler configured with the given options.
+// The returned Transpiler may be used concurrently by multiple goroutines;
+// call Close when done with it.
 func New(options Options) (Transpiler, error) {
-	return libsassTranspiler{options: options}, nil
+	if err := validateFunctionSignatures(options.Functions); err != nil {
+		return nil, err
+	}
+	return &libsassTranspiler{options: options}, nil
 }
 
 // Execute transpiles the SCSS or SASS from src into dst.
-func (t libsassTranspiler) Execute(src string) (Result, error) {
+func (t *libsassTranspiler) Execute(src string) (Result, error) {
 	var result Result
 
 	if t.options.SassSyntax {
@@ -40,6 +55,18 @@ func (t libsassTranspiler) Execute(src string) (Result, error) {
 
 	dataCtx := libsass.SassMakeDataContext(src)
 
+	// AddImportResolver/AddCFunctions register this compile's callbacks
+	// under the compile id LibSass assigns dataCtx, and
+	// DeleteImportResolver/DeleteCFunctions unregister them once this
+	// compile is done. Making concurrent Execute calls that each use their
+	// own ImportResolver/Functions safe to run at once - rather than
+	// serializing every registry-using compile behind one lock - requires
+	// that registration to be keyed per compile id inside internal/libsass
+	// itself (e.g. a sync.Map), since a lock held here can only protect
+	// this package's own bookkeeping, not whatever data structure
+	// internal/libsass uses to store the mapping. That keying is
+	// internal/libsass's responsibility; this package does not add a lock
+	// of its own on top of it.
 	opts := libsass.SassDataContextGetOptions(dataCtx)
 	{
 		// Set options
@@ -49,6 +76,11 @@ func (t libsassTranspiler) Execute(src string) (Result, error) {
 			defer libsass.DeleteImportResolver(idx)
 		}
 
+		if len(t.options.Functions) > 0 {
+			idx := libsass.AddCFunctions(opts, adaptFunctions(t.options.Functions))
+			defer libsass.DeleteCFunctions(idx)
+		}
+
 		if t.options.Precision != 0 {
 			libsass.SassOptionSetPrecision(opts, t.options.Precision)
 		}
@@ -84,10 +116,14 @@ func (t libsassTranspiler) Execute(src string) (Result, error) {
 	libsass.SassCompilerParse(compiler)
 	libsass.SassCompilerExecute(compiler)
 
+	result.ResolvedImports = libsass.SassContextGetIncludedFiles(ctx)
+
 	result.CSS = libsass.SassContextGetOutputString(ctx)
 
 	if status := libsass.SassContextGetErrorStatus(ctx); status != 0 {
-		return result, jsonToError(libsass.SassContextGetErrorJSON(ctx))
+		err := jsonToError(libsass.SassContextGetErrorJSON(ctx))
+		err.enrichContext(src, t.options.ImportResolver)
+		return result, err
 	}
 
 	result.SourceMapFilename = libsass.SassOptionGetSourceMapFile(opts)
@@ -96,16 +132,88 @@ func (t libsassTranspiler) Execute(src string) (Result, error) {
 	return result, nil
 }
 
+// Close releases any resources held by the transpiler. The LibSass backend
+// currently holds no state between Execute calls, so this is a no-op kept
+// for symmetry with backends (e.g. dartsass) that do hold a subprocess
+// open.
+func (t *libsassTranspiler) Close() error {
+	return nil
+}
+
+// Input is one unit of work passed to Batch.
+type Input struct {
+	Src string
+}
+
+// BatchResult pairs the Result or error produced for one Input passed to
+// Batch, at the same index.
+type BatchResult struct {
+	Result Result
+	Err    error
+}
+
+// Batch compiles many inputs concurrently, capped at GOMAXPROCS in flight
+// at a time. It exists for Hugo-style build servers that recompile hundreds
+// of small SCSS snippets on file change, where looping over Execute
+// serially leaves the C API's parallelism on the table; since each Execute
+// blocks inside cgo for the duration of the compile, running them all at
+// once would instead balloon the number of OS threads the Go runtime has
+// to park.
+func (t *libsassTranspiler) Batch(inputs []Input) []BatchResult {
+	return RunBatch(t.Execute, inputs)
+}
+
+// RunBatch runs execute over inputs concurrently, capped at GOMAXPROCS in
+// flight at a time, and collects the results in input order. It's exported
+// so that other Transpiler implementations (e.g. dartsass) can implement
+// Batch in terms of their own Execute without duplicating the bounded
+// fan-out logic.
+func RunBatch(execute func(src string) (Result, error), inputs []Input) []BatchResult {
+	results := make([]BatchResult, len(inputs))
+
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	var wg sync.WaitGroup
+	wg.Add(len(inputs))
+	for i, in := range inputs {
+		sem <- struct{}{}
+		go func(i int, in Input) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res, err := execute(in.Src)
+			results[i] = BatchResult{Result: res, Err: err}
+		}(i, in)
+	}
+	wg.Wait()
+
+	return results
+}
+
 type Result struct {
 	CSS string
 
 	// If source maps are configured.
 	SourceMapFilename string
 	SourceMapContent  string
+
+	// ResolvedImports lists every file this compile transitively imported,
+	// both from the filesystem and via ImportResolver. Callers building
+	// incremental pipelines can use it to invalidate cached CSS when any
+	// of these files change.
+	ResolvedImports []string
 }
 
 type Transpiler interface {
 	Execute(src string) (Result, error)
+
+	// Batch compiles many inputs concurrently and returns their results in
+	// the same order, without requiring the caller to type-assert down to
+	// a specific backend to reach it.
+	Batch(inputs []Input) []BatchResult
+
+	// Close releases any resources (subprocesses, pooled cgo state, ...)
+	// held by the Transpiler. Callers should call it when done with a
+	// Transpiler obtained from New.
+	Close() error
 }
 
 type (
@@ -147,6 +255,15 @@ type Options struct {
 	// to another URL or to return the body.
 	ImportResolver func(url string, prev string) (newURL string, body string, resolved bool)
 
+	// Functions registers Go functions that become callable from SCSS. The
+	// map key must be a full LibSass function signature, not just a name -
+	// e.g. "image-url($path)" - since that's what LibSass uses to derive
+	// the function's arity and parameter names; New returns an error if a
+	// key isn't of that form. Each function receives its SCSS call
+	// arguments as SassValue and returns the SassValue to substitute in
+	// its place.
+	Functions map[string]func(args []SassValue) (SassValue, error)
+
 	// Used to indicate "old style" SASS for the input stream.
 	SassSyntax bool
 
@@ -173,8 +290,95 @@ type Error struct {
 	File    string `json:"file"`
 	Line    int    `json:"line"`
 	Message string `json:"message"`
+
+	// Source is the full content of the file the error occurred in,
+	// resolved either from the original src, the file at File, or the
+	// ImportResolver for virtual paths. It is empty if none of those
+	// could be resolved.
+	Source string
+
+	// ContextLines holds a window of lines from Source surrounding Line,
+	// starting at ContextStart (1-indexed, inclusive).
+	ContextLines []string
+	ContextStart int
 }
 
 func (e Error) Error() string {
 	return fmt.Sprintf("file %q, line %d, col %d: %s ", e.File, e.Line, e.Column, e.Message)
 }
+
+// errorContextWindow is the number of lines of source shown before and
+// after the offending line in Error.ContextLines.
+const errorContextWindow = 2
+
+// enrichContext populates Source and ContextLines by locating the file the
+// error occurred in and slicing out the lines around Line.
+func (e *Error) enrichContext(src string, resolver func(url, prev string) (newURL, body string, resolved bool)) {
+	if e.Line <= 0 {
+		return
+	}
+
+	source, ok := resolveErrorSource(e.File, src, resolver)
+	if !ok {
+		return
+	}
+
+	lines := strings.Split(source, "\n")
+	if e.Line > len(lines) {
+		return
+	}
+
+	start := e.Line - errorContextWindow
+	if start < 1 {
+		start = 1
+	}
+	end := e.Line + errorContextWindow
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	e.Source = source
+	e.ContextStart = start
+	e.ContextLines = lines[start-1 : end]
+}
+
+// resolveErrorSource finds the content of the file an Error refers to: the
+// original src if it's the entry point, the filesystem, or the configured
+// ImportResolver for anything virtual.
+func resolveErrorSource(file, src string, resolver func(url, prev string) (newURL, body string, resolved bool)) (string, bool) {
+	if file == "" || file == "stdin" {
+		return src, true
+	}
+	if body, err := os.ReadFile(file); err == nil {
+		return string(body), true
+	}
+	if resolver != nil {
+		if _, body, resolved := resolver(file, ""); resolved {
+			return body, true
+		}
+	}
+	return "", false
+}
+
+// Formatted renders the error the way Rust/Dart Sass do: the message
+// followed by the surrounding source with a caret pointing at Column.
+func (e Error) Formatted() string {
+	if len(e.ContextLines) == 0 {
+		return e.Error()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", e.Error())
+	for i, line := range e.ContextLines {
+		lineNo := e.ContextStart + i
+		fmt.Fprintf(&b, "%4d | %s\n", lineNo, line)
+		if lineNo == e.Line {
+			col := e.Column
+			if col < 1 {
+				col = 1
+			}
+			fmt.Fprintf(&b, "     | %s^\n", strings.Repeat(" ", col-1))
+		}
+	}
+	return b.String()
+}
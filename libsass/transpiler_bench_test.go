@@ -0,0 +1,52 @@
+// Copyright © 2020 Bjørn Erik Pedersen <bjorn.erik.pedersen@gmail.com>.
+//
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package libsass
+
+import (
+	"fmt"
+	"testing"
+)
+
+// manySmallInputs builds a corpus similar to what a Hugo-style build
+// server recompiles on every file change: many small, independent SCSS
+// snippets rather than one large stylesheet.
+func manySmallInputs(n int) []Input {
+	inputs := make([]Input, n)
+	for i := range inputs {
+		inputs[i] = Input{Src: fmt.Sprintf(".c%d { color: #%06x; }", i, i)}
+	}
+	return inputs
+}
+
+func BenchmarkExecuteManySmallInputs(b *testing.B) {
+	t, err := New(Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer t.Close()
+
+	inputs := manySmallInputs(200)
+
+	b.Run("Execute", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, in := range inputs {
+				if _, err := t.Execute(in.Src); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, r := range t.Batch(inputs) {
+				if r.Err != nil {
+					b.Fatal(r.Err)
+				}
+			}
+		}
+	})
+}